@@ -0,0 +1,166 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"strconv"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"knative.dev/pkg/metrics"
+)
+
+var (
+	statefulSetNameKey = tag.MustNewKey("statefulset_name")
+	podOrdinalKey      = tag.MustNewKey("pod")
+	nodeNameKey        = tag.MustNewKey("node")
+	zoneNameKey        = tag.MustNewKey("zone")
+
+	capacityStat = stats.Int64(
+		"scheduler_state_capacity",
+		"Total vreplica capacity of the StatefulSet",
+		stats.UnitDimensionless)
+	freeCapacityStat = stats.Int64(
+		"scheduler_state_free_capacity",
+		"Aggregate free vreplica capacity across schedulable pods",
+		stats.UnitDimensionless)
+	podFreeCapacityStat = stats.Int64(
+		"scheduler_state_pod_free_capacity",
+		"Free vreplica capacity of a single pod",
+		stats.UnitDimensionless)
+	podLoadStat = stats.Int64(
+		"scheduler_state_pod_load",
+		"Vreplica load of a single pod",
+		stats.UnitDimensionless)
+	schedulablePodsStat = stats.Int64(
+		"scheduler_state_schedulable_pods",
+		"Number of pods eligible for scheduling",
+		stats.UnitDimensionless)
+	replicasStat = stats.Int64(
+		"scheduler_state_replicas",
+		"Scale of the StatefulSet backing the scheduler",
+		stats.UnitDimensionless)
+	pendingVReplicasStat = stats.Int64(
+		"scheduler_state_pending_vreplicas",
+		"Sum of vreplicas across all vpods that haven't been scheduled yet",
+		stats.UnitDimensionless)
+	vpodsPendingStat = stats.Int64(
+		"scheduler_state_vpods_pending",
+		"Number of vpods with a non-zero number of pending vreplicas",
+		stats.UnitDimensionless)
+	podsPerNodeStat = stats.Int64(
+		"scheduler_state_pods_per_node",
+		"Number of schedulable pods bound to a node",
+		stats.UnitDimensionless)
+	podsPerZoneStat = stats.Int64(
+		"scheduler_state_pods_per_zone",
+		"Number of schedulable pods bound to a zone",
+		stats.UnitDimensionless)
+)
+
+func init() {
+	tagKeys := []tag.Key{statefulSetNameKey}
+	register := func(m stats.Measure, agg *view.Aggregation, keys ...tag.Key) {
+		v := &view.View{
+			Name:        m.Name(),
+			Description: m.Description(),
+			Measure:     m,
+			Aggregation: agg,
+			TagKeys:     append(append([]tag.Key{}, tagKeys...), keys...),
+		}
+		if err := view.Register(v); err != nil {
+			panic(err)
+		}
+	}
+
+	register(capacityStat, view.LastValue())
+	register(freeCapacityStat, view.LastValue())
+	register(podFreeCapacityStat, view.LastValue(), podOrdinalKey)
+	register(podLoadStat, view.LastValue(), podOrdinalKey)
+	register(schedulablePodsStat, view.LastValue())
+	register(replicasStat, view.LastValue())
+	register(pendingVReplicasStat, view.LastValue())
+	register(vpodsPendingStat, view.LastValue())
+	register(podsPerNodeStat, view.LastValue(), nodeNameKey)
+	register(podsPerZoneStat, view.LastValue(), zoneNameKey)
+}
+
+// MetricsReporter records the measurements that describe a freshly built
+// State, so operators get the same kind of cluster-state visibility that
+// dedicated k8s-state exporters provide, scoped to the scheduler's world
+// view. Implementations must be safe to call from stateBuilder.State on
+// every build.
+type MetricsReporter interface {
+	Report(ctx context.Context, statefulSetName string, state *State)
+}
+
+// OpenCensusReporter is the MetricsReporter used in production: it records
+// every measurement through knative.dev/pkg/metrics, tagged by StatefulSet
+// name (and, where relevant, pod ordinal, node or zone).
+type OpenCensusReporter struct{}
+
+// Report implements MetricsReporter.
+func (OpenCensusReporter) Report(ctx context.Context, statefulSetName string, state *State) {
+	ctx, err := tag.New(ctx, tag.Upsert(statefulSetNameKey, statefulSetName))
+	if err != nil {
+		return
+	}
+
+	metrics.Record(ctx, capacityStat.M(int64(state.Capacity)))
+	metrics.Record(ctx, freeCapacityStat.M(int64(state.FreeCapacity())))
+	metrics.Record(ctx, schedulablePodsStat.M(int64(len(state.SchedulablePods))))
+	metrics.Record(ctx, replicasStat.M(int64(state.Replicas)))
+
+	var pendingSum int64
+	var vpodsPending int64
+	for _, pending := range state.Pending {
+		pendingSum += int64(pending)
+		if pending > 0 {
+			vpodsPending++
+		}
+	}
+	metrics.Record(ctx, pendingVReplicasStat.M(pendingSum))
+	metrics.Record(ctx, vpodsPendingStat.M(vpodsPending))
+
+	for _, ordinal := range state.SchedulablePods {
+		podCtx, err := tag.New(ctx, tag.Upsert(podOrdinalKey, strconv.Itoa(int(ordinal))))
+		if err != nil {
+			continue
+		}
+		metrics.Record(podCtx, podFreeCapacityStat.M(int64(state.FreeCap[ordinal])))
+		metrics.Record(podCtx, podLoadStat.M(int64(state.Capacity-state.FreeCap[ordinal])))
+	}
+
+	for node, count := range state.NumPodsPerNode {
+		nodeCtx, err := tag.New(ctx, tag.Upsert(nodeNameKey, node))
+		if err != nil {
+			continue
+		}
+		metrics.Record(nodeCtx, podsPerNodeStat.M(int64(count)))
+	}
+
+	for zone, count := range state.NumPodsPerZone {
+		zoneCtx, err := tag.New(ctx, tag.Upsert(zoneNameKey, zone))
+		if err != nil {
+			continue
+		}
+		metrics.Record(zoneCtx, podsPerZoneStat.M(int64(count)))
+	}
+}
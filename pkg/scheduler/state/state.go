@@ -0,0 +1,1003 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package state reconciles the in-memory view of a StatefulSet-backed
+// scheduler (pods, their vreplica load and their topology) so that the
+// schedulers in this package can make placement decisions without
+// talking to the API server on every call.
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	"knative.dev/eventing/pkg/scheduler"
+)
+
+// ZoneLabel is the well-known label used to group nodes by availability zone.
+const ZoneLabel = "topology.kubernetes.io/zone"
+
+// ZoneLabelLegacy is the deprecated form of ZoneLabel, kept around for
+// clusters that haven't migrated their node labels yet.
+const ZoneLabelLegacy = "failure-domain.beta.kubernetes.io/zone"
+
+// SchedulerPolicyType identifies the granularity at which a scheduler should
+// try to evenly spread a vpod's replicas.
+type SchedulerPolicyType string
+
+const (
+	// PodSpreadPolicyType spreads vreplicas across as many pods as possible.
+	PodSpreadPolicyType SchedulerPolicyType = "PodSpread"
+	// NodeSpreadPolicyType spreads vreplicas across as many nodes as possible.
+	NodeSpreadPolicyType SchedulerPolicyType = "NodeSpread"
+	// ZoneSpreadPolicyType spreads vreplicas across as many zones as possible.
+	ZoneSpreadPolicyType SchedulerPolicyType = "ZoneSpread"
+)
+
+// State provides information about the current scheduling of all vpods
+// on the set of pods of the scheduler's StatefulSet, so that the scheduler
+// can take informed placement decisions.
+//
+// When the *State was built through a StateCache, it is a live view, not an
+// immutable snapshot: when only vpods changed, the next call to
+// stateBuilder.State on that same StateCache mutates this same State (its
+// slices and maps, including each per-vpod spread map) in place and returns
+// it again; when pods, nodes or the StatefulSet's scale changed, it returns a
+// new State after reusing this one's FreeCap backing array and emptying its
+// per-vpod spread maps. Use it
+// before making any other call that could touch the cache, and don't range
+// over its maps or slices concurrently with one. A caller that needs a
+// stable copy to retain or hand to another goroutine should call Clone.
+type State struct {
+	// FreeCap is the free vreplica capacity of each pod, indexed by pod ordinal.
+	FreeCap []int32
+
+	// SchedulablePods is the list of pod ordinals that can be used for scheduling.
+	SchedulablePods []int32
+
+	// LastOrdinal is the ordinal index of the last pod in the StatefulSet.
+	LastOrdinal int32
+
+	// Capacity is the total capacity of each pod (scheduler.Policy.Capacity).
+	Capacity int32
+
+	// Replicas is the scale of the StatefulSet.
+	Replicas int32
+
+	// StatefulSetName is the name of the StatefulSet backing the scheduler.
+	StatefulSetName string
+
+	// SchedulerPolicy is the even-spread granularity configured via
+	// WithSchedulerPolicy. Spread uses it to pick which of PodSpread,
+	// NodeSpread or ZoneSpread is the operative constraint for a vpod;
+	// all three maps are always populated regardless of policy.
+	SchedulerPolicy SchedulerPolicyType
+
+	// PodSpread returns the spread of vreplicas across pods for each vpod.
+	PodSpread map[types.NamespacedName]map[string]int32
+
+	// NodeSpread returns the spread of vreplicas across nodes for each vpod.
+	NodeSpread map[types.NamespacedName]map[string]int32
+
+	// ZoneSpread returns the spread of vreplicas across zones for each vpod.
+	ZoneSpread map[types.NamespacedName]map[string]int32
+
+	// NumPodsPerNode is the number of schedulable pods per node.
+	NumPodsPerNode map[string]int32
+
+	// NumPodsPerZone is the number of schedulable pods per zone.
+	NumPodsPerZone map[string]int32
+
+	// Pending tracks the number of vreplicas that haven't been scheduled yet,
+	// for each vpod.
+	Pending map[types.NamespacedName]int32
+
+	// ExpectedVReplicaByVPod is the expected number of vreplicas for each vpod.
+	ExpectedVReplicaByVPod map[types.NamespacedName]int32
+
+	// PodLister can be used to retrieve the current pods of the StatefulSet.
+	PodLister corev1listers.PodNamespaceLister
+
+	// IsPartial is true when the build that produced this State was cut
+	// short by ctx being cancelled or its deadline exceeded. Callers that
+	// can't tolerate an incomplete view (e.g. anything about to place new
+	// work) should treat a partial State the same as an error. Like every
+	// other field on a cache-backed State, it reflects only the most recent
+	// call; see the type's doc comment.
+	IsPartial bool
+}
+
+// Clone returns a deep-enough copy of s that's safe to retain or hand to
+// another goroutine: FreeCap, SchedulablePods and every map (including each
+// vpod's per-pod/per-node/per-zone spread map) are copied, so a later call
+// to the stateBuilder.State that produced s can't mutate the clone. This is
+// the escape hatch for the "live view" caveat on State's doc comment; most
+// callers that only read s before their next call to State don't need it.
+func (s *State) Clone() *State {
+	clone := *s
+	clone.FreeCap = append([]int32(nil), s.FreeCap...)
+	clone.SchedulablePods = append([]int32(nil), s.SchedulablePods...)
+	clone.PodSpread = cloneSpread(s.PodSpread)
+	clone.NodeSpread = cloneSpread(s.NodeSpread)
+	clone.ZoneSpread = cloneSpread(s.ZoneSpread)
+	clone.NumPodsPerNode = cloneCounts(s.NumPodsPerNode)
+	clone.NumPodsPerZone = cloneCounts(s.NumPodsPerZone)
+	clone.Pending = cloneVPodCounts(s.Pending)
+	clone.ExpectedVReplicaByVPod = cloneVPodCounts(s.ExpectedVReplicaByVPod)
+	return &clone
+}
+
+func cloneSpread(m map[types.NamespacedName]map[string]int32) map[types.NamespacedName]map[string]int32 {
+	out := make(map[types.NamespacedName]map[string]int32, len(m))
+	for k, v := range m {
+		out[k] = cloneCounts(v)
+	}
+	return out
+}
+
+func cloneCounts(m map[string]int32) map[string]int32 {
+	out := make(map[string]int32, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func cloneVPodCounts(m map[types.NamespacedName]int32) map[types.NamespacedName]int32 {
+	out := make(map[types.NamespacedName]int32, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// FreeCapacity returns the total free capacity across schedulable pods.
+func (s *State) FreeCapacity() int32 {
+	var total int32
+	for _, ordinal := range s.SchedulablePods {
+		total += s.FreeCap[ordinal]
+	}
+	return total
+}
+
+// Spread returns vpod's spread map at the granularity configured by
+// SchedulerPolicy (pod, node or zone), so callers that want to honor the
+// even-spread policy don't have to special-case it themselves.
+func (s *State) Spread(vpod types.NamespacedName) map[string]int32 {
+	switch s.SchedulerPolicy {
+	case NodeSpreadPolicyType:
+		return s.NodeSpread[vpod]
+	case ZoneSpreadPolicyType:
+		return s.ZoneSpread[vpod]
+	default:
+		return s.PodSpread[vpod]
+	}
+}
+
+// stateBuilder reconciles the current state from the lister(s).
+type stateBuilder struct {
+	statefulSetName string
+	vpodLister      scheduler.VPodLister
+	capacity        int32
+	podLister       corev1listers.PodNamespaceLister
+	nodeLister      corev1listers.NodeLister
+	scaleCache      *scheduler.ScaleCache
+	schedulerPolicy SchedulerPolicyType
+	cache           *StateCache
+	filters         eligibilityChain
+	metricsReporter MetricsReporter
+	config          StateBuilderConfig
+}
+
+// StateBuilderConfig controls how State behaves when building a State takes
+// too long, e.g. because the pod informer is still syncing or the scale
+// subresource call is slow.
+type StateBuilderConfig struct {
+	// MaxBuildDuration bounds how long State is allowed to run before its
+	// context is treated as cancelled. Zero means no additional deadline is
+	// imposed beyond whatever the caller's ctx already carries.
+	MaxBuildDuration time.Duration
+
+	// AllowPartial makes State return a best-effort *State (with IsPartial
+	// set) alongside the context error instead of returning nil, err. This
+	// is useful during controller startup and leader-election handoff,
+	// where waiting on a full sync would otherwise stall reconciliation.
+	AllowPartial bool
+}
+
+// NewStateBuilder returns a StateBuilder that builds the scheduler State from
+// the StatefulSet's pods and the registered vpods. nodeLister is used to
+// resolve each pod's node so that node- and zone-level spread can be tracked
+// in addition to pod-level spread.
+//
+// Every pod is always required to be bound to a node whose taints it all
+// tolerates and which carries a zone label; filters, if any, are evaluated in addition to that baseline,
+// and a pod failing any of them is excluded from State.SchedulablePods the
+// same way a pending or tainted pod is.
+func NewStateBuilder(sfsName string, lister scheduler.VPodLister, podCapacity int32, podlister corev1listers.PodNamespaceLister, nodeLister corev1listers.NodeLister, scaleCache *scheduler.ScaleCache, filters ...EligibilityFilter) *stateBuilder {
+	return &stateBuilder{
+		statefulSetName: sfsName,
+		vpodLister:      lister,
+		capacity:        podCapacity,
+		podLister:       podlister,
+		nodeLister:      nodeLister,
+		scaleCache:      scaleCache,
+		schedulerPolicy: PodSpreadPolicyType,
+		filters:         append(eligibilityChain{TaintTolerationFilter{}, ZoneLabelFilter{}}, filters...),
+	}
+}
+
+// EligibilityFilter decides whether a pod bound to node is eligible to be
+// used for scheduling. Filters run once per pod while State is built, before
+// any vpod placement is taken into account, and prune State.SchedulablePods
+// the same way the built-in pending/taint/zone checks do.
+type EligibilityFilter interface {
+	Eligible(ctx context.Context, podOrdinal int32, pod *v1.Pod, node *v1.Node) bool
+}
+
+// EligibilityFilterFunc adapts a plain function to an EligibilityFilter.
+type EligibilityFilterFunc func(ctx context.Context, podOrdinal int32, pod *v1.Pod, node *v1.Node) bool
+
+// Eligible implements EligibilityFilter.
+func (f EligibilityFilterFunc) Eligible(ctx context.Context, podOrdinal int32, pod *v1.Pod, node *v1.Node) bool {
+	return f(ctx, podOrdinal, pod, node)
+}
+
+// eligibilityChain runs every filter in order and is eligible only if all of
+// them are, short-circuiting on the first rejection.
+type eligibilityChain []EligibilityFilter
+
+func (c eligibilityChain) Eligible(ctx context.Context, podOrdinal int32, pod *v1.Pod, node *v1.Node) bool {
+	for _, f := range c {
+		if !f.Eligible(ctx, podOrdinal, pod, node) {
+			return false
+		}
+	}
+	return true
+}
+
+// TaintTolerationFilter excludes pods bound to a node whose taints aren't
+// all tolerated by the pod, mirroring the kube-scheduler's own taint check.
+type TaintTolerationFilter struct{}
+
+// Eligible implements EligibilityFilter.
+func (TaintTolerationFilter) Eligible(_ context.Context, _ int32, pod *v1.Pod, node *v1.Node) bool {
+	for i := range node.Spec.Taints {
+		if !tolerates(pod.Spec.Tolerations, &node.Spec.Taints[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func tolerates(tolerations []v1.Toleration, taint *v1.Taint) bool {
+	for _, t := range tolerations {
+		if t.ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// ZoneLabelFilter excludes pods bound to a node that carries neither
+// ZoneLabel nor ZoneLabelLegacy, since their placements can't be attributed
+// to a zone for spread purposes.
+type ZoneLabelFilter struct{}
+
+// Eligible implements EligibilityFilter.
+func (ZoneLabelFilter) Eligible(_ context.Context, _ int32, _ *v1.Pod, node *v1.Node) bool {
+	_, ok := zoneLabel(node)
+	return ok
+}
+
+// NodeSelectorFilter excludes pods bound to a node that doesn't carry every
+// label in Selector. Selector is typically the node selector configured on
+// the vpod owner's pod template, supplied by the caller at construction time
+// since EligibilityFilter runs once per pod rather than once per vpod.
+type NodeSelectorFilter struct {
+	Selector map[string]string
+}
+
+// Eligible implements EligibilityFilter.
+func (f NodeSelectorFilter) Eligible(_ context.Context, _ int32, _ *v1.Pod, node *v1.Node) bool {
+	for k, v := range f.Selector {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ResourcePressureFilter excludes pods bound to a node reporting
+// MemoryPressure or DiskPressure.
+type ResourcePressureFilter struct{}
+
+// Eligible implements EligibilityFilter.
+func (ResourcePressureFilter) Eligible(_ context.Context, _ int32, _ *v1.Pod, node *v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Status != v1.ConditionTrue {
+			continue
+		}
+		if cond.Type == v1.NodeMemoryPressure || cond.Type == v1.NodeDiskPressure {
+			return false
+		}
+	}
+	return true
+}
+
+// EligibleZonesFilter excludes pods bound to a node whose zone isn't in
+// Zones, analogous to the volume-binder's GetEligibleNodes pruning the
+// candidate set ahead of the main scheduling loop.
+type EligibleZonesFilter struct {
+	Zones sets.Set[string]
+}
+
+// Eligible implements EligibilityFilter.
+func (f EligibleZonesFilter) Eligible(_ context.Context, _ int32, _ *v1.Pod, node *v1.Node) bool {
+	zone, ok := zoneLabel(node)
+	return ok && f.Zones.Has(zone)
+}
+
+// WithSchedulerPolicy sets the granularity at which even-spread constraints
+// should be tracked and returns the builder for chaining.
+func (s *stateBuilder) WithSchedulerPolicy(policy SchedulerPolicyType) *stateBuilder {
+	s.schedulerPolicy = policy
+	return s
+}
+
+// WithStateCache makes the builder reuse and incrementally update cache
+// across calls to State, instead of rebuilding every map and slice from
+// scratch. This matters once the number of vpods grows into the thousands,
+// where a full rebuild on every reconcile becomes the dominant cost. The
+// trade-off is that every *State this builder returns afterwards is a live
+// view into cache, mutated in place (or, after a pod/node/scale change,
+// partly overwritten) by the next call to State: see State's doc comment,
+// and call (*State).Clone
+// before handing one to code that runs concurrently with or after a later
+// State call.
+func (s *stateBuilder) WithStateCache(cache *StateCache) *stateBuilder {
+	s.cache = cache
+	return s
+}
+
+// WithMetricsReporter makes the builder report gauge/counter measurements
+// for every State it builds. Tests that want to stay silent should leave
+// this unset: the builder doesn't report anything by default.
+func (s *stateBuilder) WithMetricsReporter(reporter MetricsReporter) *stateBuilder {
+	s.metricsReporter = reporter
+	return s
+}
+
+// WithConfig sets the deadline/cancellation behaviour of State and returns
+// the builder for chaining. Reconciler entrypoints that construct a
+// stateBuilder should set AllowPartial and treat an IsPartial State as
+// "don't schedule new work this round" rather than letting a slow
+// pod-informer sync or scale lookup stall the reconcile loop.
+func (s *stateBuilder) WithConfig(config StateBuilderConfig) *stateBuilder {
+	s.config = config
+	return s
+}
+
+// State builds a new State from the current content of the listers. If the
+// builder was configured WithStateCache, pods are only rescanned when the
+// pods, nodes or scale have changed since the last call, and vpods are diffed individually so
+// that unrelated vpods don't pay for each other's churn.
+//
+// ctx is checked at every major step (vpod listing, pod listing, and the
+// per-vpod placement walk); once it's done, State stops making progress and,
+// depending on s.config.AllowPartial, either returns the best-effort *State
+// built so far with IsPartial set, or nil, alongside ctx.Err().
+func (s *stateBuilder) State(ctx context.Context) (*State, error) {
+	if s.config.MaxBuildDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.MaxBuildDuration)
+		defer cancel()
+	}
+
+	vpods, err := s.vpodLister()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return s.partialOrNil(nil, 0, err)
+	}
+
+	scale, err := s.scaleCache.GetScale(ctx, s.statefulSetName, scheduler.ScaleSubresource)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return s.partialOrNil(nil, 0, ctxErr)
+		}
+		return nil, fmt.Errorf("failed to get scale subresource for statefulset %s: %w", s.statefulSetName, err)
+	}
+	replicas := scale.Spec.Replicas
+
+	pods, err := s.podLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return s.partialOrNil(nil, replicas, err)
+	}
+
+	var state *State
+	if s.cache != nil {
+		var nodes []*v1.Node
+		nodes, err = s.nodeLister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return s.partialOrNil(nil, replicas, err)
+		}
+		state, err = s.cache.build(ctx, s, replicas, pods, nodes, vpods)
+	} else {
+		state, _, err = buildFull(ctx, s, replicas, pods, vpods, newSpreadMaps(), nil)
+	}
+	if err != nil {
+		return s.partialOrNil(state, replicas, err)
+	}
+
+	if s.metricsReporter != nil {
+		s.metricsReporter.Report(ctx, s.statefulSetName, state)
+	}
+	return state, nil
+}
+
+// partialOrNil turns a context error encountered mid-build into either
+// nil, err (AllowPartial is false: bail out entirely) or state, err with
+// state.IsPartial set (AllowPartial is true: best-effort snapshot),
+// synthesizing an empty State if the build didn't get far enough to produce
+// one of its own. replicas is the StatefulSet scale if it was already known
+// when ctx was found to be done, or 0 if the build was cut short before
+// GetScale returned; it only affects the synthesized State, since one
+// returned by buildFull/StateCache already carries its own Replicas.
+func (s *stateBuilder) partialOrNil(state *State, replicas int32, err error) (*State, error) {
+	if !s.config.AllowPartial {
+		return nil, err
+	}
+	if state == nil {
+		state = &State{
+			Capacity:               s.capacity,
+			Replicas:               replicas,
+			LastOrdinal:            replicas - 1,
+			StatefulSetName:        s.statefulSetName,
+			SchedulerPolicy:        s.schedulerPolicy,
+			FreeCap:                []int32{},
+			SchedulablePods:        []int32{},
+			PodSpread:              map[types.NamespacedName]map[string]int32{},
+			NodeSpread:             map[types.NamespacedName]map[string]int32{},
+			ZoneSpread:             map[types.NamespacedName]map[string]int32{},
+			NumPodsPerNode:         map[string]int32{},
+			NumPodsPerZone:         map[string]int32{},
+			Pending:                map[types.NamespacedName]int32{},
+			ExpectedVReplicaByVPod: map[types.NamespacedName]int32{},
+			PodLister:              s.podLister,
+		}
+	}
+	state.IsPartial = true
+	return state, err
+}
+
+// podTopology is the per-ordinal topology data derived from the pod/node
+// listers, kept separate from State so that StateCache can reuse it across
+// calls without changing State's exported shape.
+type podTopology struct {
+	schedulable map[int32]bool
+	podToNode   map[string]string
+	podToZone   map[string]string
+}
+
+// scanTopology resolves every pod's node and zone, populating topo and the
+// per-node/per-zone pod counts. Ordinals default to unschedulable and are
+// only flipped to schedulable once they've actually passed every check, so
+// that if ctx is cancelled before every pod could be scanned (the returned
+// bool is then false), the ordinals not yet reached stay conservatively
+// unschedulable instead of being assumed fit for placement.
+func (s *stateBuilder) scanTopology(ctx context.Context, replicas int32, pods []*v1.Pod) (podTopology, map[string]int32, map[string]int32, bool) {
+	topo := podTopology{
+		schedulable: make(map[int32]bool, replicas),
+		podToNode:   make(map[string]string, replicas),
+		podToZone:   make(map[string]string, replicas),
+	}
+	numPodsPerNode := make(map[string]int32)
+	numPodsPerZone := make(map[string]int32)
+
+	for _, pod := range pods {
+		if err := ctx.Err(); err != nil {
+			return topo, numPodsPerNode, numPodsPerZone, false
+		}
+
+		ordinal, err := ordinalFromPodName(s.statefulSetName, pod.Name)
+		if err != nil || ordinal >= replicas {
+			continue
+		}
+
+		if pod.Spec.NodeName == "" {
+			// Pod hasn't been bound to a node yet: it cannot be used for scheduling.
+			continue
+		}
+
+		node, err := s.nodeLister.Get(pod.Spec.NodeName)
+		if err != nil {
+			continue
+		}
+
+		if !s.filters.Eligible(ctx, ordinal, pod, node) {
+			continue
+		}
+
+		topo.schedulable[ordinal] = true
+		zone, _ := zoneLabel(node)
+		topo.podToNode[pod.Name] = node.Name
+		topo.podToZone[pod.Name] = zone
+		numPodsPerNode[node.Name]++
+		numPodsPerZone[zone]++
+	}
+
+	return topo, numPodsPerNode, numPodsPerZone, true
+}
+
+// spreadMaps bundles the per-vpod maps so they can be passed around (and
+// recycled through a StateCache) as a unit.
+type spreadMaps struct {
+	podSpread  map[types.NamespacedName]map[string]int32
+	nodeSpread map[types.NamespacedName]map[string]int32
+	zoneSpread map[types.NamespacedName]map[string]int32
+	pending    map[types.NamespacedName]int32
+	expected   map[types.NamespacedName]int32
+}
+
+func newSpreadMaps() spreadMaps {
+	return spreadMaps{
+		podSpread:  make(map[types.NamespacedName]map[string]int32),
+		nodeSpread: make(map[types.NamespacedName]map[string]int32),
+		zoneSpread: make(map[types.NamespacedName]map[string]int32),
+		pending:    make(map[types.NamespacedName]int32, 4),
+		expected:   make(map[types.NamespacedName]int32),
+	}
+}
+
+// buildFull computes a State from scratch. It's used directly when the
+// builder has no StateCache, and as the fallback path the cache takes when
+// pods, nodes or scale have changed since the last build. It returns the topology
+// it scanned along the way so a StateCache can reuse it for later
+// incremental vpod updates.
+//
+// If ctx is done before every vpod's placements have been walked, buildFull
+// stops early, marks the returned State as partial and returns ctx.Err();
+// everything built up to that point is still returned so the caller can
+// decide whether a best-effort snapshot is acceptable.
+func buildFull(ctx context.Context, s *stateBuilder, replicas int32, pods []*v1.Pod, vpods []scheduler.VPod, maps spreadMaps, prevFreeCap []int32) (*State, podTopology, error) {
+	free := prevFreeCap[:0]
+	if free == nil {
+		free = make([]int32, 0, replicas)
+	}
+	for ordinal := int32(0); ordinal < replicas; ordinal++ {
+		free = append(free, s.capacity)
+	}
+
+	topo, numPodsPerNode, numPodsPerZone, complete := s.scanTopology(ctx, replicas, pods)
+
+	var buildErr error
+	if !complete {
+		buildErr = ctx.Err()
+	}
+
+	for _, vpod := range vpods {
+		if buildErr == nil {
+			buildErr = ctx.Err()
+		}
+		if buildErr != nil {
+			break
+		}
+
+		key := vpod.GetKey()
+
+		ps := make(map[string]int32)
+		ns := make(map[string]int32)
+		zs := make(map[string]int32)
+		maps.podSpread[key] = ps
+		maps.nodeSpread[key] = ns
+		maps.zoneSpread[key] = zs
+
+		assigned := applyPlacements(s.statefulSetName, vpod, free, topo, ps, ns, zs)
+		maps.expected[key] = vpod.GetVReplicas()
+		maps.pending[key] = pendingFor(maps.expected[key], assigned)
+	}
+
+	schedulablePodsList := make([]int32, 0, len(topo.schedulable))
+	for ordinal := int32(0); ordinal < replicas; ordinal++ {
+		if topo.schedulable[ordinal] {
+			schedulablePodsList = append(schedulablePodsList, ordinal)
+		}
+	}
+
+	return &State{
+		FreeCap:                free,
+		SchedulablePods:        schedulablePodsList,
+		LastOrdinal:            replicas - 1,
+		Capacity:               s.capacity,
+		Replicas:               replicas,
+		StatefulSetName:        s.statefulSetName,
+		SchedulerPolicy:        s.schedulerPolicy,
+		PodSpread:              maps.podSpread,
+		NodeSpread:             maps.nodeSpread,
+		ZoneSpread:             maps.zoneSpread,
+		NumPodsPerNode:         numPodsPerNode,
+		NumPodsPerZone:         numPodsPerZone,
+		Pending:                maps.pending,
+		ExpectedVReplicaByVPod: maps.expected,
+		PodLister:              s.podLister,
+		IsPartial:              buildErr != nil,
+	}, topo, buildErr
+}
+
+// applyPlacements accounts for a single vpod's placements against free,
+// populating ps/ns/zs, and returns the total number of vreplicas assigned
+// (including those on pods that are no longer schedulable).
+func applyPlacements(statefulSetName string, vpod scheduler.VPod, free []int32, topo podTopology, ps, ns, zs map[string]int32) int32 {
+	var assigned int32
+	for _, placement := range vpod.GetPlacements() {
+		assigned += placement.VReplicas
+
+		ordinal, err := ordinalFromPodName(statefulSetName, placement.PodName)
+		if err != nil || int(ordinal) >= len(free) {
+			continue
+		}
+
+		free[ordinal] -= placement.VReplicas
+
+		if !topo.schedulable[ordinal] {
+			continue
+		}
+
+		ps[placement.PodName] += placement.VReplicas
+		if node, ok := topo.podToNode[placement.PodName]; ok {
+			ns[node] += placement.VReplicas
+		}
+		if zone, ok := topo.podToZone[placement.PodName]; ok {
+			zs[zone] += placement.VReplicas
+		}
+	}
+	return assigned
+}
+
+func pendingFor(expected, assigned int32) int32 {
+	if p := expected - assigned; p > 0 {
+		return p
+	}
+	return 0
+}
+
+// GetVPod returns the vpod matching key, or nil if not found.
+func GetVPod(key types.NamespacedName, vpods []scheduler.VPod) scheduler.VPod {
+	for _, v := range vpods {
+		if v.GetKey() == key {
+			return v
+		}
+	}
+	return nil
+}
+
+// zoneLabel returns the node's availability zone, preferring the stable
+// topology.kubernetes.io/zone label over the deprecated beta one.
+func zoneLabel(node *v1.Node) (string, bool) {
+	if zone, ok := node.Labels[ZoneLabel]; ok && zone != "" {
+		return zone, true
+	}
+	if zone, ok := node.Labels[ZoneLabelLegacy]; ok && zone != "" {
+		return zone, true
+	}
+	return "", false
+}
+
+// ordinalFromPodName extracts the StatefulSet ordinal from a pod name of the
+// form "<statefulSetName>-<ordinal>".
+func ordinalFromPodName(statefulSetName, podName string) (int32, error) {
+	if !strings.HasPrefix(podName, statefulSetName+"-") {
+		return 0, fmt.Errorf("pod %s does not belong to statefulset %s", podName, statefulSetName)
+	}
+	suffix := podName[len(statefulSetName)+1:]
+	ordinal, err := strconv.ParseInt(suffix, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse ordinal from pod name %s: %w", podName, err)
+	}
+	return int32(ordinal), nil
+}
+
+// vpodSnapshot is what StateCache remembers about a vpod between builds, so
+// it can tell whether it changed and, if so, undo its old contribution to
+// State before applying the new one.
+type vpodSnapshot struct {
+	expected   int32
+	placements []duckv1alpha1.Placement
+}
+
+func snapshotOf(vpod scheduler.VPod) vpodSnapshot {
+	placements := vpod.GetPlacements()
+	return vpodSnapshot{
+		expected:   vpod.GetVReplicas(),
+		placements: append([]duckv1alpha1.Placement(nil), placements...),
+	}
+}
+
+func (v vpodSnapshot) equal(other vpodSnapshot) bool {
+	if v.expected != other.expected || len(v.placements) != len(other.placements) {
+		return false
+	}
+	for i := range v.placements {
+		if v.placements[i] != other.placements[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// StateCache keeps the last State built for a StatefulSet, together with the
+// topology it was built from, so that repeated calls to stateBuilder.State
+// don't reallocate FreeCap and every per-vpod map from scratch. Pods, nodes
+// and scale are cheap to fingerprint and rare to change relative to vpod
+// churn, so a pod/node/scale change falls back to a full rebuild (nodes
+// matter because a node's taints, conditions and zone label all feed into
+// per-pod eligibility, and none of that is rechecked by the incremental
+// per-vpod path); individual vpod adds/removes/updates are instead applied
+// as in-place deltas against the cached State, and their scratch maps are
+// recycled through a sync.Pool.
+type StateCache struct {
+	mu sync.Mutex
+
+	state *State
+	topo  podTopology
+
+	replicas    int32
+	podsDigest  string
+	nodesDigest string
+	vpods       map[types.NamespacedName]vpodSnapshot
+
+	mapPool sync.Pool
+}
+
+// NewStateCache returns an empty StateCache ready to be passed to
+// stateBuilder.WithStateCache.
+func NewStateCache() *StateCache {
+	return &StateCache{
+		vpods: make(map[types.NamespacedName]vpodSnapshot),
+		mapPool: sync.Pool{
+			New: func() interface{} { return make(map[string]int32) },
+		},
+	}
+}
+
+func (c *StateCache) getMap() map[string]int32 {
+	return c.mapPool.Get().(map[string]int32)
+}
+
+func (c *StateCache) putMap(m map[string]int32) {
+	for k := range m {
+		delete(m, k)
+	}
+	c.mapPool.Put(m)
+}
+
+// podsDigest fingerprints the pods relevant to scheduling (name, resource
+// version and node binding) so StateCache can tell cheaply whether a full
+// topology rescan is needed.
+func podsDigest(pods []*v1.Pod) string {
+	names := make([]string, len(pods))
+	for i, pod := range pods {
+		names[i] = pod.Name + "=" + pod.ResourceVersion + "@" + pod.Spec.NodeName
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// nodesDigest fingerprints every node's resource version, so StateCache
+// notices taints, conditions (MemoryPressure/DiskPressure) or zone labels
+// changing even though no pod was added, removed or rescheduled. A node's
+// ResourceVersion changes on any update to it, including to Spec.Taints,
+// Status.Conditions or Labels, so this is enough to catch all of them
+// without re-deriving a narrower per-field digest.
+func nodesDigest(nodes []*v1.Node) string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name + "=" + node.ResourceVersion
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (c *StateCache) build(ctx context.Context, s *stateBuilder, replicas int32, pods []*v1.Pod, nodes []*v1.Node, vpods []scheduler.VPod) (*State, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	podDigest := podsDigest(pods)
+	nodeDigest := nodesDigest(nodes)
+
+	if c.state == nil || c.replicas != replicas || c.podsDigest != podDigest || c.nodesDigest != nodeDigest {
+		return c.rebuild(ctx, s, replicas, pods, vpods, podDigest, nodeDigest)
+	}
+	return c.update(ctx, s, vpods)
+}
+
+// rebuild recomputes State and its topology from scratch, used whenever
+// pods, nodes or the StatefulSet's scale have changed since the last build.
+//
+// If buildFull is cut short by ctx, the partial State it produced is
+// returned to the caller but not committed to the cache: caching an
+// incomplete topology/vpod snapshot would corrupt later incremental
+// updates. The previously cached State has by then had its spread maps
+// drained into the pool and its FreeCap reused, so it is dropped as well,
+// and the next call does a full rebuild from scratch.
+func (c *StateCache) rebuild(ctx context.Context, s *stateBuilder, replicas int32, pods []*v1.Pod, vpods []scheduler.VPod, podDigest, nodeDigest string) (*State, error) {
+	for _, m := range c.poolableMaps() {
+		c.putMap(m)
+	}
+
+	var prevFreeCap []int32
+	if c.state != nil {
+		prevFreeCap = c.state.FreeCap
+	}
+	state, topo, err := buildFull(ctx, s, replicas, pods, vpods, newSpreadMaps(), prevFreeCap)
+	if err != nil {
+		c.state = nil
+		return state, err
+	}
+
+	c.state = state
+	c.topo = topo
+	c.replicas = replicas
+	c.podsDigest = podDigest
+	c.nodesDigest = nodeDigest
+	c.vpods = make(map[types.NamespacedName]vpodSnapshot, len(vpods))
+	for _, vpod := range vpods {
+		c.vpods[vpod.GetKey()] = snapshotOf(vpod)
+	}
+	return c.state, nil
+}
+
+// update applies per-vpod deltas to the cached State in place: unchanged
+// vpods are skipped entirely, changed/new ones have their old FreeCap
+// contribution reverted and the new one applied, and removed vpods are
+// dropped, with their scratch maps returned to the pool.
+//
+// If ctx is done partway through, update stops applying further deltas,
+// marks state as partial and returns ctx.Err(); vpods already processed
+// this call keep their new contribution, and the remaining removal sweep
+// is skipped entirely rather than run against a half-updated seen set.
+func (c *StateCache) update(ctx context.Context, s *stateBuilder, vpods []scheduler.VPod) (*State, error) {
+	state := c.state
+	seen := make(map[types.NamespacedName]bool, len(vpods))
+
+	var buildErr error
+	for _, vpod := range vpods {
+		if err := ctx.Err(); err != nil {
+			buildErr = err
+			break
+		}
+
+		key := vpod.GetKey()
+		seen[key] = true
+
+		next := snapshotOf(vpod)
+		prev, existed := c.vpods[key]
+		if existed && prev.equal(next) {
+			continue
+		}
+		if existed {
+			c.revert(state, prev)
+		}
+
+		ps := c.mapForKey(state.PodSpread, key)
+		ns := c.mapForKey(state.NodeSpread, key)
+		zs := c.mapForKey(state.ZoneSpread, key)
+
+		assigned := applyPlacements(s.statefulSetName, vpod, state.FreeCap, c.topo, ps, ns, zs)
+		state.ExpectedVReplicaByVPod[key] = next.expected
+		state.Pending[key] = pendingFor(next.expected, assigned)
+
+		c.vpods[key] = next
+	}
+
+	if buildErr == nil {
+		for key, prev := range c.vpods {
+			if seen[key] {
+				continue
+			}
+			c.revert(state, prev)
+			c.dropKey(state, key)
+			delete(c.vpods, key)
+		}
+	}
+
+	state.IsPartial = buildErr != nil
+	return state, buildErr
+}
+
+// mapForKey returns the existing per-vpod map for key, clearing it, or a
+// pooled one if this is the first time key is seen.
+func (c *StateCache) mapForKey(spread map[types.NamespacedName]map[string]int32, key types.NamespacedName) map[string]int32 {
+	if m, ok := spread[key]; ok {
+		for k := range m {
+			delete(m, k)
+		}
+		return m
+	}
+	m := c.getMap()
+	spread[key] = m
+	return m
+}
+
+// dropKey removes a vpod's entries from every per-vpod map on state,
+// recycling the pod/node/zone spread maps back into the pool.
+func (c *StateCache) dropKey(state *State, key types.NamespacedName) {
+	if m, ok := state.PodSpread[key]; ok {
+		c.putMap(m)
+		delete(state.PodSpread, key)
+	}
+	if m, ok := state.NodeSpread[key]; ok {
+		c.putMap(m)
+		delete(state.NodeSpread, key)
+	}
+	if m, ok := state.ZoneSpread[key]; ok {
+		c.putMap(m)
+		delete(state.ZoneSpread, key)
+	}
+	delete(state.Pending, key)
+	delete(state.ExpectedVReplicaByVPod, key)
+}
+
+// revert undoes a vpod's previous contribution to FreeCap ahead of either
+// recomputing it (update) or dropping it entirely (removal).
+func (c *StateCache) revert(state *State, prev vpodSnapshot) {
+	for _, p := range prev.placements {
+		ordinal, err := ordinalFromPodName(state.StatefulSetName, p.PodName)
+		if err != nil || int(ordinal) >= len(state.FreeCap) {
+			continue
+		}
+		state.FreeCap[ordinal] += p.VReplicas
+	}
+}
+
+// poolableMaps returns every per-vpod map currently tracked by the cached
+// state, so they can be drained back into the pool ahead of a full rebuild.
+func (c *StateCache) poolableMaps() []map[string]int32 {
+	if c.state == nil {
+		return nil
+	}
+	out := make([]map[string]int32, 0, len(c.state.PodSpread)*3)
+	for _, m := range c.state.PodSpread {
+		out = append(out, m)
+	}
+	for _, m := range c.state.NodeSpread {
+		out = append(out, m)
+	}
+	for _, m := range c.state.ZoneSpread {
+		out = append(out, m)
+	}
+	return out
+}
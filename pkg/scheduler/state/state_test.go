@@ -17,17 +17,24 @@ limitations under the License.
 package state
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	corev1 "k8s.io/client-go/listers/core/v1"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
 
@@ -49,6 +56,9 @@ func TestStateBuilder(t *testing.T) {
 		name            string
 		replicas        int32
 		pendingReplicas int32
+		taintedOrdinals []int32
+		noZoneOrdinals  []int32
+		policy          SchedulerPolicyType
 		vpods           [][]duckv1alpha1.Placement
 		expected        State
 		freec           int32
@@ -71,6 +81,18 @@ func TestStateBuilder(t *testing.T) {
 						"statefulset-name-0": 1,
 					},
 				},
+				NodeSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"node-0": 1,
+					},
+				},
+				ZoneSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"zone-0": 1,
+					},
+				},
+				NumPodsPerNode: map[string]int32{"node-0": 1},
+				NumPodsPerZone: map[string]int32{"zone-0": 1},
 				Pending: map[types.NamespacedName]int32{
 					{Name: "vpod-name-0", Namespace: "vpod-ns-0"}: 0,
 				},
@@ -102,6 +124,33 @@ func TestStateBuilder(t *testing.T) {
 						"statefulset-name-1": 3,
 					},
 				},
+				NodeSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"node-0": 1,
+						"node-2": 5,
+					},
+					{Name: vpodName + "-1", Namespace: vpodNs + "-1"}: {
+						"node-1": 2,
+					},
+					{Name: vpodName + "-2", Namespace: vpodNs + "-2"}: {
+						"node-0": 1,
+						"node-1": 3,
+					},
+				},
+				ZoneSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"zone-0": 6,
+					},
+					{Name: vpodName + "-1", Namespace: vpodNs + "-1"}: {
+						"zone-1": 2,
+					},
+					{Name: vpodName + "-2", Namespace: vpodNs + "-2"}: {
+						"zone-0": 1,
+						"zone-1": 3,
+					},
+				},
+				NumPodsPerNode: map[string]int32{"node-0": 1, "node-1": 1, "node-2": 1},
+				NumPodsPerZone: map[string]int32{"zone-0": 2, "zone-1": 1},
 				Pending: map[types.NamespacedName]int32{
 					{Name: "vpod-name-0", Namespace: "vpod-ns-0"}: 0,
 					{Name: "vpod-name-1", Namespace: "vpod-ns-1"}: 0,
@@ -136,6 +185,30 @@ func TestStateBuilder(t *testing.T) {
 						"statefulset-name-1": 3,
 					},
 				},
+				NodeSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"node-2": 5,
+					},
+					{Name: vpodName + "-1", Namespace: vpodNs + "-1"}: {
+						"node-1": 2,
+					},
+					{Name: vpodName + "-2", Namespace: vpodNs + "-2"}: {
+						"node-1": 3,
+					},
+				},
+				ZoneSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"zone-0": 5,
+					},
+					{Name: vpodName + "-1", Namespace: vpodNs + "-1"}: {
+						"zone-1": 2,
+					},
+					{Name: vpodName + "-2", Namespace: vpodNs + "-2"}: {
+						"zone-1": 3,
+					},
+				},
+				NumPodsPerNode: map[string]int32{"node-1": 1, "node-2": 1},
+				NumPodsPerZone: map[string]int32{"zone-0": 1, "zone-1": 1},
 				Pending: map[types.NamespacedName]int32{
 					{Name: "vpod-name-0", Namespace: "vpod-ns-0"}: 0,
 					{Name: "vpod-name-1", Namespace: "vpod-ns-1"}: 0,
@@ -171,6 +244,32 @@ func TestStateBuilder(t *testing.T) {
 						"statefulset-name-3": 0,
 					},
 				},
+				NodeSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"node-0": 1,
+						"node-2": 5,
+					},
+					{Name: vpodName + "-1", Namespace: vpodNs + "-1"}: {
+						"node-1": 0,
+					},
+					{Name: vpodName + "-2", Namespace: vpodNs + "-2"}: {
+						"node-1": 0,
+						"node-3": 0,
+					},
+				},
+				ZoneSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"zone-0": 6,
+					},
+					{Name: vpodName + "-1", Namespace: vpodNs + "-1"}: {
+						"zone-1": 0,
+					},
+					{Name: vpodName + "-2", Namespace: vpodNs + "-2"}: {
+						"zone-1": 0,
+					},
+				},
+				NumPodsPerNode: map[string]int32{"node-0": 1, "node-1": 1, "node-2": 1, "node-3": 1},
+				NumPodsPerZone: map[string]int32{"zone-0": 2, "zone-1": 2},
 				Pending: map[types.NamespacedName]int32{
 					{Name: "vpod-name-0", Namespace: "vpod-ns-0"}: 0,
 					{Name: "vpod-name-1", Namespace: "vpod-ns-1"}: 1,
@@ -185,15 +284,31 @@ func TestStateBuilder(t *testing.T) {
 			freec: int32(34),
 		},
 		{
-			name:     "three vpods but one tainted and one with no zone label",
-			replicas: int32(1),
-			vpods:    [][]duckv1alpha1.Placement{{{PodName: "statefulset-name-0", VReplicas: 1}}},
-			expected: State{Capacity: 10, FreeCap: []int32{int32(9)}, SchedulablePods: []int32{int32(0)}, LastOrdinal: 0, Replicas: 1, StatefulSetName: sfsName,
+			name:            "three pods but one tainted and one with no zone label",
+			replicas:        int32(3),
+			taintedOrdinals: []int32{1},
+			noZoneOrdinals:  []int32{2},
+			vpods: [][]duckv1alpha1.Placement{
+				{{PodName: "statefulset-name-0", VReplicas: 1}, {PodName: "statefulset-name-1", VReplicas: 2}, {PodName: "statefulset-name-2", VReplicas: 3}},
+			},
+			expected: State{Capacity: 10, FreeCap: []int32{int32(9), int32(8), int32(7)}, SchedulablePods: []int32{int32(0)}, LastOrdinal: 2, Replicas: 3, StatefulSetName: sfsName,
 				PodSpread: map[types.NamespacedName]map[string]int32{
 					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
 						"statefulset-name-0": 1,
 					},
 				},
+				NodeSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"node-0": 1,
+					},
+				},
+				ZoneSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"zone-0": 1,
+					},
+				},
+				NumPodsPerNode: map[string]int32{"node-0": 1},
+				NumPodsPerZone: map[string]int32{"zone-0": 1},
 				Pending: map[types.NamespacedName]int32{
 					{Name: "vpod-name-0", Namespace: "vpod-ns-0"}: 0,
 				},
@@ -206,6 +321,7 @@ func TestStateBuilder(t *testing.T) {
 		{
 			name:     "one vpod (HA)",
 			replicas: int32(1),
+			policy:   ZoneSpreadPolicyType,
 			vpods:    [][]duckv1alpha1.Placement{{{PodName: "statefulset-name-0", VReplicas: 1}}},
 			expected: State{Capacity: 10, FreeCap: []int32{int32(9)}, SchedulablePods: []int32{int32(0)}, LastOrdinal: 0, Replicas: 1, StatefulSetName: sfsName,
 				PodSpread: map[types.NamespacedName]map[string]int32{
@@ -213,6 +329,18 @@ func TestStateBuilder(t *testing.T) {
 						"statefulset-name-0": 1,
 					},
 				},
+				NodeSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"node-0": 1,
+					},
+				},
+				ZoneSpread: map[types.NamespacedName]map[string]int32{
+					{Name: vpodName + "-0", Namespace: vpodNs + "-0"}: {
+						"zone-0": 1,
+					},
+				},
+				NumPodsPerNode: map[string]int32{"node-0": 1},
+				NumPodsPerZone: map[string]int32{"zone-0": 1},
 				Pending: map[types.NamespacedName]int32{
 					{Name: "vpod-name-0", Namespace: "vpod-ns-0"}: 0,
 				},
@@ -228,12 +356,15 @@ func TestStateBuilder(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			ctx, _ := tscheduler.SetupFakeContext(t)
 			vpodClient := tscheduler.NewVPodClient()
-			podlist := make([]runtime.Object, 0, tc.replicas)
+			objs := make([]runtime.Object, 0, tc.replicas*2)
 
 			if tc.pendingReplicas > tc.replicas {
 				t.Fatalf("Inconsistent test configuration pending replicas %d greater than replicas %d", tc.pendingReplicas, tc.replicas)
 			}
 
+			tainted := sets.New(tc.taintedOrdinals...)
+			noZone := sets.New(tc.noZoneOrdinals...)
+
 			for i, placements := range tc.vpods {
 				vpodName := fmt.Sprint(vpodName+"-", i)
 				vpodNamespace := fmt.Sprint(vpodNs+"-", i)
@@ -260,11 +391,19 @@ func TestStateBuilder(t *testing.T) {
 					nodeName := "node-" + fmt.Sprint(i)
 					podName := sfsName + "-" + fmt.Sprint(i)
 					pod, err = kubeclient.Get(ctx).CoreV1().Pods(testNs).Create(ctx, tscheduler.MakePod(testNs, podName, nodeName), metav1.CreateOptions{})
+					if err != nil {
+						t.Fatal("unexpected error", err)
+					}
+					zone := fmt.Sprintf("zone-%d", i%2)
+					if noZone.Has(i) {
+						zone = ""
+					}
+					objs = append(objs, tscheduler.MakeNode(nodeName, zone, tainted.Has(i)))
 				}
 				if err != nil {
 					t.Fatal("unexpected error", err)
 				}
-				podlist = append(podlist, pod)
+				objs = append(objs, pod)
 			}
 
 			_, err := kubeclient.Get(ctx).AppsV1().StatefulSets(testNs).Create(ctx, tscheduler.MakeStatefulset(testNs, sfsName, tc.replicas), metav1.CreateOptions{})
@@ -272,23 +411,44 @@ func TestStateBuilder(t *testing.T) {
 				t.Fatal("unexpected error", err)
 			}
 
-			lsp := listers.NewListers(podlist)
+			lsp := listers.NewListers(objs)
 
 			scaleCache := scheduler.NewScaleCache(ctx, testNs, kubeclient.Get(ctx).AppsV1().StatefulSets(testNs), scheduler.ScaleCacheConfig{RefreshPeriod: time.Minute * 5})
 
-			stateBuilder := NewStateBuilder(sfsName, vpodClient.List, int32(10), lsp.GetPodLister().Pods(testNs), scaleCache)
+			stateBuilder := NewStateBuilder(sfsName, vpodClient.List, int32(10), lsp.GetPodLister().Pods(testNs), lsp.GetNodeLister(), scaleCache)
+			if tc.policy != "" {
+				stateBuilder = stateBuilder.WithSchedulerPolicy(tc.policy)
+			}
 			state, err := stateBuilder.State(ctx)
 			if err != nil {
 				t.Fatal("unexpected error", err)
 			}
 
 			tc.expected.PodLister = lsp.GetPodLister().Pods(testNs)
+			if tc.expected.SchedulerPolicy == "" {
+				tc.expected.SchedulerPolicy = PodSpreadPolicyType
+				if tc.policy != "" {
+					tc.expected.SchedulerPolicy = tc.policy
+				}
+			}
 			if tc.expected.FreeCap == nil {
 				tc.expected.FreeCap = make([]int32, 0, 256)
 			}
 			if tc.expected.PodSpread == nil {
 				tc.expected.PodSpread = make(map[types.NamespacedName]map[string]int32)
 			}
+			if tc.expected.NodeSpread == nil {
+				tc.expected.NodeSpread = make(map[types.NamespacedName]map[string]int32)
+			}
+			if tc.expected.ZoneSpread == nil {
+				tc.expected.ZoneSpread = make(map[types.NamespacedName]map[string]int32)
+			}
+			if tc.expected.NumPodsPerNode == nil {
+				tc.expected.NumPodsPerNode = make(map[string]int32)
+			}
+			if tc.expected.NumPodsPerZone == nil {
+				tc.expected.NumPodsPerZone = make(map[string]int32)
+			}
 			if !reflect.DeepEqual(*state, tc.expected) {
 				diff := cmp.Diff(tc.expected, *state, cmpopts.IgnoreInterfaces(struct{ corev1.PodNamespaceLister }{}))
 				t.Errorf("unexpected state, got %v, want %v\n(-want, +got)\n%s", *state, tc.expected, diff)
@@ -297,6 +457,580 @@ func TestStateBuilder(t *testing.T) {
 			if state.FreeCapacity() != tc.freec {
 				t.Errorf("unexpected free capacity, got %d, want %d", state.FreeCapacity(), tc.freec)
 			}
+
+			if len(tc.vpods) > 0 {
+				firstVPod := types.NamespacedName{Name: vpodName + "-0", Namespace: vpodNs + "-0"}
+				wantSpread := tc.expected.PodSpread[firstVPod]
+				switch tc.policy {
+				case NodeSpreadPolicyType:
+					wantSpread = tc.expected.NodeSpread[firstVPod]
+				case ZoneSpreadPolicyType:
+					wantSpread = tc.expected.ZoneSpread[firstVPod]
+				}
+				if gotSpread := state.Spread(firstVPod); !reflect.DeepEqual(gotSpread, wantSpread) {
+					t.Errorf("unexpected state.Spread() for policy %q, got %v, want %v", tc.policy, gotSpread, wantSpread)
+				}
+			}
 		})
 	}
 }
+
+// newFilterTestWorld sets up two pods, each on its own node, plus a single
+// vpod placed on both, and returns a build function that creates the listers
+// and calls State with whatever extra EligibilityFilter the test wants to
+// exercise. node0/node1 are returned so the caller can customize their labels
+// or status ahead of the NewStateBuilder call.
+func newFilterTestWorld(t *testing.T) (ctx context.Context, node0, node1 *v1.Node, build func(filters ...EligibilityFilter) *State) {
+	t.Helper()
+	ctx, _ = tscheduler.SetupFakeContext(t)
+
+	vpodClient := tscheduler.NewVPodClient()
+	vpodClient.Create(vpodNs, vpodName, 1, []duckv1alpha1.Placement{
+		{PodName: sfsName + "-0", VReplicas: 1},
+		{PodName: sfsName + "-1", VReplicas: 1},
+	})
+
+	node0 = tscheduler.MakeNode("node-0", "zone-0", false)
+	node1 = tscheduler.MakeNode("node-1", "zone-1", false)
+
+	objs := make([]runtime.Object, 0, 4)
+	for i, node := range []*v1.Node{node0, node1} {
+		podName := fmt.Sprintf("%s-%d", sfsName, i)
+		pod, err := kubeclient.Get(ctx).CoreV1().Pods(testNs).Create(ctx, tscheduler.MakePod(testNs, podName, node.Name), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		objs = append(objs, pod, node)
+	}
+
+	if _, err := kubeclient.Get(ctx).AppsV1().StatefulSets(testNs).Create(ctx, tscheduler.MakeStatefulset(testNs, sfsName, 2), metav1.CreateOptions{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	return ctx, node0, node1, func(filters ...EligibilityFilter) *State {
+		lsp := listers.NewListers(objs)
+		scaleCache := scheduler.NewScaleCache(ctx, testNs, kubeclient.Get(ctx).AppsV1().StatefulSets(testNs), scheduler.ScaleCacheConfig{RefreshPeriod: time.Minute * 5})
+		state, err := NewStateBuilder(sfsName, vpodClient.List, int32(10), lsp.GetPodLister().Pods(testNs), lsp.GetNodeLister(), scaleCache, filters...).State(ctx)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		return state
+	}
+}
+
+func TestNodeSelectorFilter(t *testing.T) {
+	_, _, node1, build := newFilterTestWorld(t)
+	node1.Labels["disktype"] = "ssd"
+
+	state := build(NodeSelectorFilter{Selector: map[string]string{"disktype": "ssd"}})
+
+	if want := []int32{1}; !reflect.DeepEqual(state.SchedulablePods, want) {
+		t.Errorf("unexpected schedulable pods, got %v, want %v", state.SchedulablePods, want)
+	}
+	if want := int32(9); state.FreeCapacity() != want {
+		t.Errorf("unexpected free capacity, got %d, want %d", state.FreeCapacity(), want)
+	}
+}
+
+func TestResourcePressureFilter(t *testing.T) {
+	_, node0, _, build := newFilterTestWorld(t)
+	node0.Status.Conditions = append(node0.Status.Conditions, v1.NodeCondition{
+		Type:   v1.NodeMemoryPressure,
+		Status: v1.ConditionTrue,
+	})
+
+	state := build(ResourcePressureFilter{})
+
+	if want := []int32{1}; !reflect.DeepEqual(state.SchedulablePods, want) {
+		t.Errorf("unexpected schedulable pods, got %v, want %v", state.SchedulablePods, want)
+	}
+	if want := int32(9); state.FreeCapacity() != want {
+		t.Errorf("unexpected free capacity, got %d, want %d", state.FreeCapacity(), want)
+	}
+}
+
+func TestEligibleZonesFilter(t *testing.T) {
+	_, _, _, build := newFilterTestWorld(t)
+
+	state := build(EligibleZonesFilter{Zones: sets.New("zone-1")})
+
+	if want := []int32{1}; !reflect.DeepEqual(state.SchedulablePods, want) {
+		t.Errorf("unexpected schedulable pods, got %v, want %v", state.SchedulablePods, want)
+	}
+	if want := int32(9); state.FreeCapacity() != want {
+		t.Errorf("unexpected free capacity, got %d, want %d", state.FreeCapacity(), want)
+	}
+}
+
+// blockingPodLister wraps a real PodNamespaceLister and cancels ctx right
+// after List returns, simulating a pod informer that's still syncing (or a
+// slow API call) so tests can exercise State's cancellation handling
+// without an actual clock-dependent stall.
+type blockingPodLister struct {
+	corev1.PodNamespaceLister
+	cancel context.CancelFunc
+}
+
+func (b blockingPodLister) List(selector labels.Selector) ([]*v1.Pod, error) {
+	pods, err := b.PodNamespaceLister.List(selector)
+	b.cancel()
+	return pods, err
+}
+
+func TestStateBuilderHonorsCancellation(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		allowPartial bool
+	}{
+		{name: "bails out entirely when AllowPartial is false", allowPartial: false},
+		{name: "returns a partial snapshot when AllowPartial is true", allowPartial: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			baseCtx, _ := tscheduler.SetupFakeContext(t)
+			ctx, cancel := context.WithCancel(baseCtx)
+			defer cancel()
+
+			vpodClient := tscheduler.NewVPodClient()
+			vpodClient.Create(vpodNs, vpodName, 1, []duckv1alpha1.Placement{{PodName: sfsName + "-0", VReplicas: 1}})
+
+			node := tscheduler.MakeNode("node-0", "zone-0", false)
+			pod, err := kubeclient.Get(ctx).CoreV1().Pods(testNs).Create(ctx, tscheduler.MakePod(testNs, sfsName+"-0", node.Name), metav1.CreateOptions{})
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if _, err := kubeclient.Get(ctx).AppsV1().StatefulSets(testNs).Create(ctx, tscheduler.MakeStatefulset(testNs, sfsName, 1), metav1.CreateOptions{}); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+
+			lsp := listers.NewListers([]runtime.Object{pod, node})
+			scaleCache := scheduler.NewScaleCache(ctx, testNs, kubeclient.Get(ctx).AppsV1().StatefulSets(testNs), scheduler.ScaleCacheConfig{RefreshPeriod: time.Minute * 5})
+			blockingLister := blockingPodLister{PodNamespaceLister: lsp.GetPodLister().Pods(testNs), cancel: cancel}
+
+			state, err := NewStateBuilder(sfsName, vpodClient.List, int32(10), blockingLister, lsp.GetNodeLister(), scaleCache).
+				WithConfig(StateBuilderConfig{AllowPartial: tc.allowPartial}).
+				State(ctx)
+
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("unexpected error, got %v, want context.Canceled", err)
+			}
+			if tc.allowPartial {
+				if state == nil || !state.IsPartial {
+					t.Fatalf("expected a partial state with IsPartial set, got %+v", state)
+				}
+				if state.Replicas != 1 || state.LastOrdinal != 0 {
+					t.Fatalf("expected the partial state to keep the already-known replica count, got Replicas=%d LastOrdinal=%d, want 1 and 0", state.Replicas, state.LastOrdinal)
+				}
+			} else if state != nil {
+				t.Fatalf("expected a nil state when AllowPartial is false, got %+v", state)
+			}
+		})
+	}
+}
+
+// fakeVPod is a minimal scheduler.VPod used to drive large/random vpod
+// populations in the StateCache tests below without going through the
+// reconciler-backed VPod fixtures used elsewhere in this file.
+type fakeVPod struct {
+	key        types.NamespacedName
+	vreplicas  int32
+	placements []duckv1alpha1.Placement
+}
+
+func (f *fakeVPod) GetKey() types.NamespacedName            { return f.key }
+func (f *fakeVPod) GetVReplicas() int32                     { return f.vreplicas }
+func (f *fakeVPod) GetPlacements() []duckv1alpha1.Placement { return f.placements }
+
+// randomPlacements returns up to two placements onto distinct pods chosen
+// from [0, replicas), with a random vreplica count each.
+func randomPlacements(rnd *rand.Rand, replicas int32) []duckv1alpha1.Placement {
+	n := rnd.Intn(3)
+	placements := make([]duckv1alpha1.Placement, 0, n)
+	seen := make(map[int32]bool, n)
+	for len(placements) < n {
+		ordinal := int32(rnd.Intn(int(replicas)))
+		if seen[ordinal] {
+			continue
+		}
+		seen[ordinal] = true
+		placements = append(placements, duckv1alpha1.Placement{
+			PodName:   fmt.Sprintf("%s-%d", sfsName, ordinal),
+			VReplicas: int32(rnd.Intn(4)),
+		})
+	}
+	return placements
+}
+
+// newSpreadWorld sets up replicas pods spread over three zones, plus the
+// listers and scale cache needed to build state against them.
+func newSpreadWorld(tb testing.TB, replicas int32) (ctxWorld, func() ([]scheduler.VPod, error), map[types.NamespacedName]*fakeVPod) {
+	tb.Helper()
+	ctx, _ := tscheduler.SetupFakeContext(tb)
+
+	objs := make([]runtime.Object, 0, replicas*2)
+	for i := int32(0); i < replicas; i++ {
+		nodeName := fmt.Sprintf("node-%d", i)
+		podName := fmt.Sprintf("%s-%d", sfsName, i)
+		pod, err := kubeclient.Get(ctx).CoreV1().Pods(testNs).Create(ctx, tscheduler.MakePod(testNs, podName, nodeName), metav1.CreateOptions{})
+		if err != nil {
+			tb.Fatal("unexpected error", err)
+		}
+		objs = append(objs, pod, tscheduler.MakeNode(nodeName, fmt.Sprintf("zone-%d", i%3), false))
+	}
+	if _, err := kubeclient.Get(ctx).AppsV1().StatefulSets(testNs).Create(ctx, tscheduler.MakeStatefulset(testNs, sfsName, replicas), metav1.CreateOptions{}); err != nil {
+		tb.Fatal("unexpected error", err)
+	}
+
+	lsp := listers.NewListers(objs)
+	scaleCache := scheduler.NewScaleCache(ctx, testNs, kubeclient.Get(ctx).AppsV1().StatefulSets(testNs), scheduler.ScaleCacheConfig{RefreshPeriod: time.Minute * 5})
+
+	vpods := make(map[types.NamespacedName]*fakeVPod, replicas)
+	lister := func() ([]scheduler.VPod, error) {
+		out := make([]scheduler.VPod, 0, len(vpods))
+		for _, v := range vpods {
+			out = append(out, v)
+		}
+		return out, nil
+	}
+
+	return ctxWorld{ctx: ctx, podLister: lsp.GetPodLister().Pods(testNs), nodeLister: lsp.GetNodeLister(), scaleCache: scaleCache}, lister, vpods
+}
+
+// ctxWorld bundles the pieces newSpreadWorld needs to hand back so callers
+// can build as many stateBuilders against the same fixtures as they like.
+type ctxWorld struct {
+	ctx        context.Context
+	podLister  corev1.PodNamespaceLister
+	nodeLister corev1.NodeLister
+	scaleCache *scheduler.ScaleCache
+}
+
+func (w ctxWorld) newBuilder(lister scheduler.VPodLister) *stateBuilder {
+	return NewStateBuilder(sfsName, lister, int32(10), w.podLister, w.nodeLister, w.scaleCache)
+}
+
+// TestStateCacheReactsToNodeChanges builds a cache-backed State, then taints
+// one of the nodes behind it without touching any pod, and asserts the next
+// State call picks up the node change instead of reusing the topology from
+// the cache's last full rebuild.
+func TestStateCacheReactsToNodeChanges(t *testing.T) {
+	const replicas = int32(4)
+
+	world, lister, _ := newSpreadWorld(t, replicas)
+	cached := world.newBuilder(lister).WithStateCache(NewStateCache())
+
+	before, err := cached.State(world.ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(before.SchedulablePods) != int(replicas) {
+		t.Fatalf("unexpected schedulable pods before tainting, got %v, want all %d pods schedulable", before.SchedulablePods, replicas)
+	}
+
+	node, err := world.nodeLister.Get("node-0")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	node.Spec.Taints = []v1.Taint{{Key: "dedicated", Effect: v1.TaintEffectNoSchedule}}
+	node.ResourceVersion += "1" // any node update bumps ResourceVersion; simulate that here.
+
+	after, err := cached.State(world.ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	for _, ordinal := range after.SchedulablePods {
+		if ordinal == 0 {
+			t.Fatalf("pod 0 still schedulable after its node was tainted: %v (StateCache should have rebuilt on the node change)", after.SchedulablePods)
+		}
+	}
+	if len(after.SchedulablePods) != int(replicas)-1 {
+		t.Fatalf("unexpected schedulable pods after tainting, got %v, want %d pods", after.SchedulablePods, replicas-1)
+	}
+}
+
+// TestStateCacheMutatesLiveStateInPlace documents the behavior described on
+// State's doc comment: a cache-backed State is a live view, so a *State (or
+// one of its per-vpod maps) retained across a later call to State on the
+// same StateCache sees that later call's data, not a frozen snapshot of
+// what it was built from.
+func TestStateCacheMutatesLiveStateInPlace(t *testing.T) {
+	const replicas = int32(2)
+	world, lister, vpods := newSpreadWorld(t, replicas)
+	cached := world.newBuilder(lister).WithStateCache(NewStateCache())
+
+	key := types.NamespacedName{Namespace: vpodNs, Name: "vpod-a"}
+	vpods[key] = &fakeVPod{key: key, vreplicas: 3, placements: []duckv1alpha1.Placement{{PodName: sfsName + "-0", VReplicas: 3}}}
+
+	first, err := cached.State(world.ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	podSpread := first.PodSpread[key]
+	if want := map[string]int32{sfsName + "-0": 3}; !reflect.DeepEqual(podSpread, want) {
+		t.Fatalf("unexpected PodSpread before update, got %v, want %v", podSpread, want)
+	}
+
+	vpods[key] = &fakeVPod{key: key, vreplicas: 5, placements: []duckv1alpha1.Placement{{PodName: sfsName + "-1", VReplicas: 5}}}
+	second, err := cached.State(world.ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if first != second {
+		t.Fatalf("expected StateCache to return the same *State across calls, got %p and %p", first, second)
+	}
+	if want := map[string]int32{sfsName + "-1": 5}; !reflect.DeepEqual(podSpread, want) {
+		t.Fatalf("expected the map retained from the first call to reflect the second call's data, got %v, want %v", podSpread, want)
+	}
+}
+
+// TestStateClone asserts that Clone is the escape hatch for
+// TestStateCacheMutatesLiveStateInPlace: a cloned State keeps the data it
+// had when Clone was called, even once the StateCache it came from has
+// mutated the original in place.
+func TestStateClone(t *testing.T) {
+	const replicas = int32(2)
+	world, lister, vpods := newSpreadWorld(t, replicas)
+	cached := world.newBuilder(lister).WithStateCache(NewStateCache())
+
+	key := types.NamespacedName{Namespace: vpodNs, Name: "vpod-a"}
+	vpods[key] = &fakeVPod{key: key, vreplicas: 3, placements: []duckv1alpha1.Placement{{PodName: sfsName + "-0", VReplicas: 3}}}
+
+	first, err := cached.State(world.ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	clone := first.Clone()
+
+	vpods[key] = &fakeVPod{key: key, vreplicas: 5, placements: []duckv1alpha1.Placement{{PodName: sfsName + "-1", VReplicas: 5}}}
+	if _, err := cached.State(world.ctx); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if want := map[string]int32{sfsName + "-0": 3}; !reflect.DeepEqual(clone.PodSpread[key], want) {
+		t.Fatalf("expected clone to keep the state as of when it was taken, got %v, want %v", clone.PodSpread[key], want)
+	}
+	if want := int32(7); clone.FreeCap[0] != want {
+		t.Fatalf("expected clone's FreeCap to keep the state as of when it was taken, got %d, want %d", clone.FreeCap[0], want)
+	}
+}
+
+// TestStateCacheMatchesFullRebuild random-walks vpod adds/updates/removals
+// and asserts that the incrementally-updated State from a StateCache never
+// diverges from a State built from scratch against the same inputs.
+func TestStateCacheMatchesFullRebuild(t *testing.T) {
+	const replicas = int32(20)
+
+	world, lister, vpods := newSpreadWorld(t, replicas)
+	cached := world.newBuilder(lister).WithStateCache(NewStateCache())
+
+	rnd := rand.New(rand.NewSource(42))
+	for round := 0; round < 200; round++ {
+		switch rnd.Intn(3) {
+		case 0, 1: // add or update a vpod
+			key := types.NamespacedName{Namespace: vpodNs, Name: fmt.Sprintf("vpod-%d", rnd.Intn(50))}
+			vpods[key] = &fakeVPod{
+				key:        key,
+				vreplicas:  int32(rnd.Intn(5) + 1),
+				placements: randomPlacements(rnd, replicas),
+			}
+		case 2: // remove an arbitrary vpod, if any exist
+			for k := range vpods {
+				delete(vpods, k)
+				break
+			}
+		}
+
+		got, err := cached.State(world.ctx)
+		if err != nil {
+			t.Fatalf("round %d: incremental State: %v", round, err)
+		}
+
+		want, err := world.newBuilder(lister).State(world.ctx)
+		if err != nil {
+			t.Fatalf("round %d: full rebuild State: %v", round, err)
+		}
+
+		if diff := cmp.Diff(want, got, cmpopts.IgnoreInterfaces(struct{ corev1.PodNamespaceLister }{})); diff != "" {
+			t.Fatalf("round %d: incremental state diverged from full rebuild (-want +got)\n%s", round, diff)
+		}
+	}
+}
+
+// TestStateCacheReducesAllocations builds state for 10k vpods spread across
+// 200 pods and asserts that updating a handful of vpods through a StateCache
+// allocates substantially less than rebuilding the whole State from scratch.
+func TestStateCacheReducesAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocation counting over 10k vpods is slow; skipped in -short mode")
+	}
+
+	const replicas = int32(200)
+	const vpodCount = 10000
+
+	world, lister, vpods := newSpreadWorld(t, replicas)
+
+	rnd := rand.New(rand.NewSource(7))
+	for i := 0; i < vpodCount; i++ {
+		key := types.NamespacedName{Namespace: vpodNs, Name: fmt.Sprintf("vpod-%d", i)}
+		vpods[key] = &fakeVPod{
+			key:        key,
+			vreplicas:  int32(rnd.Intn(5) + 1),
+			placements: randomPlacements(rnd, replicas),
+		}
+	}
+
+	churnKey := types.NamespacedName{Namespace: vpodNs, Name: "vpod-0"}
+	mutate := func() {
+		vpods[churnKey] = &fakeVPod{
+			key:        churnKey,
+			vreplicas:  int32(rnd.Intn(5) + 1),
+			placements: randomPlacements(rnd, replicas),
+		}
+	}
+
+	cached := world.newBuilder(lister).WithStateCache(NewStateCache())
+	if _, err := cached.State(world.ctx); err != nil {
+		t.Fatalf("priming incremental builder: %v", err)
+	}
+
+	plain := world.newBuilder(lister)
+
+	incrementalAllocs := testing.AllocsPerRun(5, func() {
+		mutate()
+		if _, err := cached.State(world.ctx); err != nil {
+			t.Fatalf("incremental State: %v", err)
+		}
+	})
+	fullRebuildAllocs := testing.AllocsPerRun(5, func() {
+		mutate()
+		if _, err := plain.State(world.ctx); err != nil {
+			t.Fatalf("full rebuild State: %v", err)
+		}
+	})
+
+	if incrementalAllocs*5 > fullRebuildAllocs {
+		t.Fatalf("expected a single-vpod update through StateCache to allocate at least 5x less than a full rebuild, got %.0f incremental vs %.0f full rebuild", incrementalAllocs, fullRebuildAllocs)
+	}
+}
+
+// BenchmarkStateCacheUpdate measures the steady-state cost of updating a
+// single vpod out of 10k through a StateCache, compared to a full rebuild.
+func BenchmarkStateCacheUpdate(b *testing.B) {
+	const replicas = int32(200)
+	const vpodCount = 10000
+
+	world, lister, vpods := newSpreadWorld(b, replicas)
+
+	rnd := rand.New(rand.NewSource(7))
+	for i := 0; i < vpodCount; i++ {
+		key := types.NamespacedName{Namespace: vpodNs, Name: fmt.Sprintf("vpod-%d", i)}
+		vpods[key] = &fakeVPod{
+			key:        key,
+			vreplicas:  int32(rnd.Intn(5) + 1),
+			placements: randomPlacements(rnd, replicas),
+		}
+	}
+	churnKey := types.NamespacedName{Namespace: vpodNs, Name: "vpod-0"}
+
+	b.Run("incremental", func(b *testing.B) {
+		cached := world.newBuilder(lister).WithStateCache(NewStateCache())
+		if _, err := cached.State(world.ctx); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			vpods[churnKey] = &fakeVPod{key: churnKey, vreplicas: 1, placements: randomPlacements(rnd, replicas)}
+			if _, err := cached.State(world.ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("full-rebuild", func(b *testing.B) {
+		plain := world.newBuilder(lister)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			vpods[churnKey] = &fakeVPod{key: churnKey, vreplicas: 1, placements: randomPlacements(rnd, replicas)}
+			if _, err := plain.State(world.ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestOpenCensusReporterEmitsExpectedMeasurements(t *testing.T) {
+	ctx, _, _, build := newFilterTestWorld(t)
+
+	state := build()
+	OpenCensusReporter{}.Report(ctx, sfsName, state)
+
+	wantRows := map[string]int64{
+		capacityStat.Name():         10,
+		freeCapacityStat.Name():     18,
+		schedulablePodsStat.Name():  2,
+		replicasStat.Name():         2,
+		pendingVReplicasStat.Name(): 0,
+		vpodsPendingStat.Name():     0,
+	}
+
+	for name, want := range wantRows {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving view %s: %v", name, err)
+		}
+		if len(rows) == 0 {
+			t.Fatalf("no data recorded for view %s", name)
+		}
+		got := rows[len(rows)-1].Data.(*view.LastValueData).Value
+		if int64(got) != want {
+			t.Errorf("unexpected value for view %s, got %v, want %d", name, got, want)
+		}
+	}
+
+	// The remaining measurements are tagged per pod, node or zone, so each
+	// expected value needs matching against the row carrying that tag
+	// rather than just the latest recorded row for the view.
+	wantTaggedRows := []struct {
+		stat  string
+		key   tag.Key
+		value string
+		want  int64
+	}{
+		{podFreeCapacityStat.Name(), podOrdinalKey, "0", 9},
+		{podFreeCapacityStat.Name(), podOrdinalKey, "1", 9},
+		{podLoadStat.Name(), podOrdinalKey, "0", 1},
+		{podLoadStat.Name(), podOrdinalKey, "1", 1},
+		{podsPerNodeStat.Name(), nodeNameKey, "node-0", 1},
+		{podsPerNodeStat.Name(), nodeNameKey, "node-1", 1},
+		{podsPerZoneStat.Name(), zoneNameKey, "zone-0", 1},
+		{podsPerZoneStat.Name(), zoneNameKey, "zone-1", 1},
+	}
+
+	for _, tc := range wantTaggedRows {
+		rows, err := view.RetrieveData(tc.stat)
+		if err != nil {
+			t.Fatalf("unexpected error retrieving view %s: %v", tc.stat, err)
+		}
+		row := rowWithTag(rows, tc.key, tc.value)
+		if row == nil {
+			t.Fatalf("no row for view %s with %s=%s, got %v", tc.stat, tc.key.Name(), tc.value, rows)
+		}
+		if got := int64(row.Data.(*view.LastValueData).Value); got != tc.want {
+			t.Errorf("unexpected value for view %s with %s=%s, got %d, want %d", tc.stat, tc.key.Name(), tc.value, got, tc.want)
+		}
+	}
+}
+
+// rowWithTag returns the row in rows tagged with key=value, or nil if none match.
+func rowWithTag(rows []*view.Row, key tag.Key, value string) *view.Row {
+	for _, row := range rows {
+		for _, t := range row.Tags {
+			if t.Key == key && t.Value == value {
+				return row
+			}
+		}
+	}
+	return nil
+}